@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
@@ -19,21 +22,96 @@ const (
 
 var languageRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z \-]*$`)
 
+// promptTemplates is the signed template registry, loaded at startup from
+// TINFOIL_PROMPT_TEMPLATES_DIR. When unset, chatHandler falls back to the
+// legacy single SYSTEM_PROMPT_TEMPLATE env var.
+var promptTemplates *templateRegistry
+
+// policies enforces the request-shape limits described in requestPolicy,
+// loaded at startup from TINFOIL_POLICY_FILE and hot-reloadable via SIGHUP.
+// Nil when TINFOIL_POLICY_FILE is unset, in which case enforcePolicy is a
+// no-op.
+var policies *policyStore
+
 func main() {
+	if path := os.Getenv("TINFOIL_POLICY_FILE"); path != "" {
+		store, err := newPolicyStore(path)
+		if err != nil {
+			log.Fatalf("Failed to load request policy: %v", err)
+		}
+		store.watchSIGHUP()
+		policies = store
+	}
+
+	if dir := os.Getenv("TINFOIL_PROMPT_TEMPLATES_DIR"); dir != "" {
+		pubKey, err := loadPromptSigningPubKey()
+		if err != nil {
+			log.Fatalf("Failed to load prompt template signing key: %v", err)
+		}
+		reg, err := loadTemplateRegistry(dir, pubKey)
+		if err != nil {
+			log.Fatalf("Failed to load prompt templates: %v", err)
+		}
+		reg.fallback = os.Getenv("TINFOIL_DEFAULT_PROMPT_TEMPLATE")
+		if reg.fallback == "" {
+			reg.fallback = "default"
+		}
+		promptTemplates = reg
+	}
+
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprint(w, "ok")
 	})
 
 	http.HandleFunc("/v1/chat/completions", chatHandler)
+	http.HandleFunc("/metrics", metrics.handler())
 
 	log.Println("Function server listening on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
+// loadPromptSigningPubKey decodes the hex-encoded Ed25519 public key from
+// TINFOIL_PROMPT_SIGNING_PUBKEY used to verify signed prompt templates.
+func loadPromptSigningPubKey() (ed25519.PublicKey, error) {
+	encoded := os.Getenv("TINFOIL_PROMPT_SIGNING_PUBKEY")
+	if encoded == "" {
+		return nil, fmt.Errorf("TINFOIL_PROMPT_SIGNING_PUBKEY not configured")
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TINFOIL_PROMPT_SIGNING_PUBKEY encoding: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("TINFOIL_PROMPT_SIGNING_PUBKEY must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
 func chatHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	trace := extractTraceContext(r)
+	tier := r.Header.Get("X-User-Tier")
+	var model string
+
+	// sw captures the status code written on every exit path (method/header
+	// validation 4xxs, policy/template rejections, upstream 5xxs, successful
+	// round-trips alike) so the deferred call below can record per-model
+	// request/error counters regardless of where the handler returns. model
+	// is filled in once the request body is parsed (step 6 below); requests
+	// rejected earlier are recorded with an empty model label.
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		metrics.incCounter("tinfoil_function_requests_total", map[string]string{"model": model, "status": fmt.Sprintf("%d", sw.status)})
+		if sw.status >= 500 {
+			metrics.incCounter("tinfoil_function_errors_total", map[string]string{"source": "upstream"})
+		} else if sw.status >= 400 {
+			metrics.incCounter("tinfoil_function_errors_total", map[string]string{"source": "client"})
+		}
+	}()
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		http.Error(sw, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -43,7 +121,7 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 		language = "English"
 	}
 	if len(language) > maxLanguageLen || !languageRegex.MatchString(language) {
-		http.Error(w, "Invalid X-Language header", http.StatusBadRequest)
+		http.Error(sw, "Invalid X-Language header", http.StatusBadRequest)
 		return
 	}
 
@@ -51,7 +129,7 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("Failed to read request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		http.Error(sw, "Failed to read request body", http.StatusInternalServerError)
 		return
 	}
 	defer r.Body.Close()
@@ -60,16 +138,45 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	var reqBody map[string]interface{}
 	if err := json.Unmarshal(body, &reqBody); err != nil {
 		log.Printf("Failed to parse request body: %v", err)
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		http.Error(sw, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	// 3.5. Reject (or, in dry-run mode, just log) requests that violate the
+	// configured per-tier policy before any further processing.
+	if !enforcePolicy(sw, policies, tier, reqBody) {
 		return
 	}
 
 	// 4. Render system prompt
-	promptTemplate := os.Getenv("SYSTEM_PROMPT_TEMPLATE")
-	if promptTemplate == "" {
-		promptTemplate = defaultSystemPrompt
+	var systemPrompt, templateHash string
+	if promptTemplates != nil {
+		tmpl, err := promptTemplates.resolve(r.Header.Get("X-Prompt-Template"), tier)
+		if err != nil {
+			log.Printf("Prompt template resolution failed: %v", err)
+			http.Error(sw, "Invalid X-Prompt-Template header", http.StatusBadRequest)
+			return
+		}
+		rendered, err := tmpl.render(templateVars{
+			Language:      language,
+			UserTier:      tier,
+			AllowedModels: r.Header.Get("X-Allowed-Models"),
+			Date:          time.Now().UTC().Format("2006-01-02"),
+		})
+		if err != nil {
+			log.Printf("Prompt template render failed: %v", err)
+			http.Error(sw, "Failed to render prompt template", http.StatusInternalServerError)
+			return
+		}
+		systemPrompt = rendered
+		templateHash = tmpl.hash
+	} else {
+		promptTemplate := os.Getenv("SYSTEM_PROMPT_TEMPLATE")
+		if promptTemplate == "" {
+			promptTemplate = defaultSystemPrompt
+		}
+		systemPrompt = strings.ReplaceAll(promptTemplate, "{{LANGUAGE}}", language)
 	}
-	systemPrompt := strings.ReplaceAll(promptTemplate, "{{LANGUAGE}}", language)
 
 	// 5. Prepend system message
 	messages, _ := reqBody["messages"].([]interface{})
@@ -88,19 +195,19 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	modifiedBody, err := json.Marshal(reqBody)
 	if err != nil {
 		log.Printf("Failed to marshal modified body: %v", err)
-		http.Error(w, "Failed to marshal request", http.StatusInternalServerError)
+		http.Error(sw, "Failed to marshal request", http.StatusInternalServerError)
 		return
 	}
 
 	// 8. Forward to inference (plain HTTPS — already inside the enclave)
 	inferenceURL := os.Getenv("TINFOIL_INFERENCE_URL")
 	if inferenceURL == "" {
-		http.Error(w, "TINFOIL_INFERENCE_URL not configured", http.StatusInternalServerError)
+		http.Error(sw, "TINFOIL_INFERENCE_URL not configured", http.StatusInternalServerError)
 		return
 	}
 	apiKey := os.Getenv("TINFOIL_API_KEY")
 	if apiKey == "" {
-		http.Error(w, "TINFOIL_API_KEY not configured", http.StatusInternalServerError)
+		http.Error(sw, "TINFOIL_API_KEY not configured", http.StatusInternalServerError)
 		return
 	}
 
@@ -108,47 +215,129 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstreamURL, bytes.NewReader(modifiedBody))
 	if err != nil {
 		log.Printf("Failed to create upstream request: %v", err)
-		http.Error(w, "Failed to create upstream request", http.StatusInternalServerError)
+		http.Error(sw, "Failed to create upstream request", http.StatusInternalServerError)
 		return
 	}
 
 	upstreamReq.Header.Set("Content-Type", "application/json")
 	upstreamReq.Header.Set("Authorization", "Bearer "+apiKey)
+	upstreamReq.Header.Set("traceparent", trace.header())
 	if accept := r.Header.Get("Accept"); accept != "" {
 		upstreamReq.Header.Set("Accept", accept)
 	}
 
+	model, _ = reqBody["model"].(string)
+
+	metrics.observe("tinfoil_function_request_bytes", map[string]string{"model": model}, float64(len(body)))
+
 	resp, err := http.DefaultClient.Do(upstreamReq)
 	if err != nil {
 		log.Printf("Upstream request failed: %v", err)
-		http.Error(w, "Upstream request failed", http.StatusBadGateway)
+		http.Error(sw, "Upstream request failed", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
-	// 9. Stream response back — tfshim re-encrypts via EHBP transparently
+	// 9. Stream response back — tfshim re-encrypts via EHBP transparently.
+	// Streamed (SSE) responses are parsed chunk-by-chunk so the
+	// ResponseTransformer pipeline can inspect/rewrite them in flight and so
+	// the terminal usage object can be aggregated into a trailer; other
+	// content types are passed through, transforming non-streamed JSON
+	// bodies in one shot.
 	if ct := resp.Header.Get("Content-Type"); ct != "" {
-		w.Header().Set("Content-Type", ct)
+		sw.Header().Set("Content-Type", ct)
 	}
-	if te := resp.Header.Get("Transfer-Encoding"); te != "" {
-		w.Header().Set("Transfer-Encoding", te)
-		w.Header().Del("Content-Length")
+	if templateHash != "" {
+		sw.Header().Set(promptTemplateHashHeader, templateHash)
 	}
 
-	w.WriteHeader(resp.StatusCode)
+	isSSE := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
 
-	if flusher, ok := w.(http.Flusher); ok {
-		fw := &flushWriter{w: w, f: flusher}
-		if _, err := io.Copy(fw, resp.Body); err != nil {
-			log.Printf("Stream copy failed: %v", err)
+	if isSSE {
+		if te := resp.Header.Get("Transfer-Encoding"); te != "" {
+			sw.Header().Set("Transfer-Encoding", te)
+			sw.Header().Del("Content-Length")
+		}
+		announceUsageTrailer(sw)
+		sw.WriteHeader(resp.StatusCode)
+
+		meter := &responseMeter{start: start}
+		// sw always implements http.Flusher (it forwards to the underlying
+		// ResponseWriter's Flusher, if any), so the streamed copy can go
+		// through flushWriter unconditionally.
+		fw := &flushWriter{w: meteredWriter{w: sw, meter: meter}, f: sw}
+		usage, err := streamChatCompletion(fw, resp.Body)
+		if err != nil {
+			log.Printf("Stream transform failed: %v", err)
+		}
+		setUsageTrailer(sw, usage)
+		if meter.timeToFirstByte > 0 {
+			metrics.observe("tinfoil_function_ttfb_seconds", map[string]string{"model": model}, meter.timeToFirstByte.Seconds())
+		}
+		if usage != nil {
+			metrics.observe("tinfoil_function_token_usage", map[string]string{"model": model}, float64(usage.TotalTokens))
 		}
 	} else {
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			log.Printf("Response copy failed: %v", err)
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Printf("Failed to read upstream response: %v", err)
+			http.Error(sw, "Failed to read upstream response", http.StatusBadGateway)
+			return
+		}
+
+		transformed, usage, err := transformNonStreamingCompletion(respBody)
+		if err != nil {
+			log.Printf("Response transform failed: %v", err)
+			http.Error(sw, "Response transform failed", http.StatusInternalServerError)
+			return
+		}
+
+		if usage != nil {
+			if value, err := json.Marshal(usage); err == nil {
+				sw.Header().Set(usageMetricsTrailer, string(value))
+			}
+			metrics.observe("tinfoil_function_token_usage", map[string]string{"model": model}, float64(usage.TotalTokens))
+		}
+		sw.Header().Set("Content-Length", fmt.Sprintf("%d", len(transformed)))
+		sw.WriteHeader(resp.StatusCode)
+		if _, err := sw.Write(transformed); err != nil {
+			log.Printf("Response write failed: %v", err)
 		}
 	}
 
-	log.Printf("Chat completion forwarded (language=%s, status=%d)", language, resp.StatusCode)
+	elapsed := time.Since(start)
+	metrics.observe("tinfoil_function_upstream_latency_seconds", map[string]string{"model": model}, elapsed.Seconds())
+	logEvent(map[string]interface{}{
+		"event":       "chat_completion_forwarded",
+		"trace_id":    trace.traceID,
+		"tier":        tier,
+		"language":    language,
+		"model":       model,
+		"status":      resp.StatusCode,
+		"duration_ms": elapsed.Milliseconds(),
+	})
+}
+
+// statusWriter wraps http.ResponseWriter, capturing the status code written
+// so callers can record metrics for a request after the handler has already
+// written its response, regardless of which exit path it took.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Flush forwards to the underlying ResponseWriter's Flusher, if any, so
+// statusWriter stays transparent to http.Flusher type assertions used for
+// SSE streaming.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
 type flushWriter struct {
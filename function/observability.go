@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- metrics -----------------------------------------------------------
+//
+// A hand-rolled counter/histogram registry exposed at /metrics in
+// Prometheus text exposition format. This example has no dependency
+// manifest to pull in the official client library, so only the subset of
+// functionality the function server needs is implemented here.
+
+var metrics = newMetricsRegistry()
+
+var latencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: latencyBuckets, counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.buckets)]++
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// labelKey renders a label set as a stable, sorted "k1=v1,k2=v2" string used
+// both as a map key and as the exposition-format label list.
+func labelKey(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metricsRegistry) incCounter(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][labelKey(labels)]++
+}
+
+func (m *metricsRegistry) observe(name string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	key := labelKey(labels)
+	h := m.histograms[name][key]
+	if h == nil {
+		h = newHistogram()
+		m.histograms[name][key] = h
+	}
+	h.observe(value)
+}
+
+// handler renders the registry in Prometheus text exposition format.
+func (m *metricsRegistry) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		for name, series := range m.counters {
+			fmt.Fprintf(w, "# TYPE %s counter\n", name)
+			for labels, value := range series {
+				if labels == "" {
+					fmt.Fprintf(w, "%s %v\n", name, value)
+				} else {
+					fmt.Fprintf(w, "%s{%s} %v\n", name, labels, value)
+				}
+			}
+		}
+
+		for name, series := range m.histograms {
+			fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+			for labels, h := range series {
+				prefix := labels
+				for i, b := range h.buckets {
+					le := fmt.Sprintf("le=%q", fmt.Sprintf("%v", b))
+					fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(prefix, le), h.counts[i])
+				}
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(prefix, `le="+Inf"`), h.counts[len(h.buckets)])
+				if prefix == "" {
+					fmt.Fprintf(w, "%s_sum %v\n", name, h.sum)
+					fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+				} else {
+					fmt.Fprintf(w, "%s_sum{%s} %v\n", name, prefix, h.sum)
+					fmt.Fprintf(w, "%s_count{%s} %d\n", name, prefix, h.count)
+				}
+			}
+		}
+	}
+}
+
+func joinLabels(existing, extra string) string {
+	if existing == "" {
+		return extra
+	}
+	return existing + "," + extra
+}
+
+// --- tracing -------------------------------------------------------------
+//
+// Minimal W3C traceparent propagation (https://www.w3.org/TR/trace-context/)
+// so a request flowing client -> proxy -> function -> inference carries a
+// shared trace ID through the chain.
+
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+}
+
+// extractTraceContext reads an inbound traceparent header (set by the
+// proxy), generating a new trace (and always a new span) if absent or
+// malformed.
+func extractTraceContext(r *http.Request) traceContext {
+	if tp := r.Header.Get("traceparent"); tp != "" {
+		parts := strings.Split(tp, "-")
+		if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+			return traceContext{traceID: parts[1], spanID: newSpanID(), flags: parts[3]}
+		}
+	}
+	return traceContext{traceID: newTraceID(), spanID: newSpanID(), flags: "01"}
+}
+
+func (tc traceContext) header() string {
+	return fmt.Sprintf("00-%s-%s-%s", tc.traceID, tc.spanID, tc.flags)
+}
+
+func newTraceID() string { return randomHex(16) }
+func newSpanID() string  { return randomHex(8) }
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand failing is effectively unrecoverable; fall back to a
+		// fixed-but-valid-shape ID rather than propagating the error into
+		// every request path.
+		return strings.Repeat("0", n*2)
+	}
+	return hex.EncodeToString(b)
+}
+
+// responseMeter tracks response byte count and time-to-first-byte for a
+// single request/response cycle.
+type responseMeter struct {
+	start           time.Time
+	bytes           int64
+	timeToFirstByte time.Duration
+}
+
+// meteredWriter wraps an io.Writer, feeding byte counts and first-write
+// timing into a responseMeter.
+type meteredWriter struct {
+	w     io.Writer
+	meter *responseMeter
+}
+
+func (m meteredWriter) Write(p []byte) (int, error) {
+	if m.meter.bytes == 0 {
+		m.meter.timeToFirstByte = time.Since(m.meter.start)
+	}
+	n, err := m.w.Write(p)
+	m.meter.bytes += int64(n)
+	return n, err
+}
+
+// --- structured logging ---------------------------------------------------
+
+// logEvent emits a single structured JSON log line. Request-scoped logging
+// should go through this (rather than log.Printf) so trace ID, tier, model,
+// and language are consistently machine-parseable.
+func logEvent(fields map[string]interface{}) {
+	fields["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("failed to marshal log event: %v", err)
+		return
+	}
+	log.Println(string(line))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// requestPolicy bounds what a chat completion request may contain before it
+// is forwarded upstream.
+type requestPolicy struct {
+	MaxMessages       int      `json:"max_messages"`
+	MaxInputTokens    int      `json:"max_input_tokens"`
+	BannedTools       []string `json:"banned_tools"`
+	DisallowedFormats []string `json:"disallowed_response_formats"`
+	MaxN              int      `json:"max_n"`
+	MaxTemperature    float64  `json:"max_temperature"`
+}
+
+// tieredPolicyConfig is the on-disk/env shape: one requestPolicy per tier
+// (plus an optional "default"), and whether violations are only logged
+// (DryRun) rather than rejected.
+type tieredPolicyConfig struct {
+	DryRun   bool                     `json:"dry_run"`
+	Policies map[string]requestPolicy `json:"policies"`
+}
+
+// policyViolation describes why a request failed policy enforcement, used
+// both in the structured 400 response body and in dry-run log lines.
+type policyViolation struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+// policyStore holds the active tieredPolicyConfig behind an atomic pointer
+// so a SIGHUP reload never blocks requests reading the current policy.
+type policyStore struct {
+	path    string
+	current atomic.Pointer[tieredPolicyConfig]
+}
+
+// newPolicyStore loads the policy file at path and returns a store ready to
+// be queried. Use watchSIGHUP to enable hot-reloading.
+func newPolicyStore(path string) (*policyStore, error) {
+	ps := &policyStore{path: path}
+	if err := ps.reload(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *policyStore) reload() error {
+	data, err := os.ReadFile(ps.path)
+	if err != nil {
+		return fmt.Errorf("read policy file: %w", err)
+	}
+	var cfg tieredPolicyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse policy file: %w", err)
+	}
+	ps.current.Store(&cfg)
+	return nil
+}
+
+// watchSIGHUP reloads the policy file whenever the process receives SIGHUP,
+// so operators can tune policies without a restart. A failed reload is
+// logged and the previous policy stays in effect.
+func (ps *policyStore) watchSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := ps.reload(); err != nil {
+				log.Printf("Policy reload failed: %v", err)
+				continue
+			}
+			log.Printf("Policy reloaded from %s", ps.path)
+		}
+	}()
+}
+
+// forTier returns the policy to apply for tier, falling back to a
+// "default" entry if the tier has no specific one.
+func (ps *policyStore) forTier(tier string) (requestPolicy, bool) {
+	cfg := ps.current.Load()
+	if cfg == nil {
+		return requestPolicy{}, false
+	}
+	if p, ok := cfg.Policies[tier]; ok {
+		return p, true
+	}
+	if p, ok := cfg.Policies["default"]; ok {
+		return p, true
+	}
+	return requestPolicy{}, false
+}
+
+func (ps *policyStore) dryRun() bool {
+	cfg := ps.current.Load()
+	return cfg != nil && cfg.DryRun
+}
+
+// estimateInputTokens is a crude ~4-chars-per-token estimator used only to
+// enforce the max_input_tokens policy; it is not meant to match the
+// upstream tokenizer exactly.
+func estimateInputTokens(chars int) int {
+	return (chars + 3) / 4
+}
+
+// evaluate checks reqBody against p, returning every violation found (not
+// just the first) so dry-run log lines and rejection responses show the
+// full picture.
+func (p requestPolicy) evaluate(reqBody map[string]interface{}) []policyViolation {
+	var violations []policyViolation
+
+	messages, _ := reqBody["messages"].([]interface{})
+	if p.MaxMessages > 0 && len(messages) > p.MaxMessages {
+		violations = append(violations, policyViolation{
+			Rule:   "max_messages",
+			Detail: fmt.Sprintf("request has %d messages, limit is %d", len(messages), p.MaxMessages),
+		})
+	}
+
+	if p.MaxInputTokens > 0 {
+		var totalChars int
+		for _, m := range messages {
+			if msg, ok := m.(map[string]interface{}); ok {
+				if content, ok := msg["content"].(string); ok {
+					totalChars += len(content)
+				}
+			}
+		}
+		if estimated := estimateInputTokens(totalChars); estimated > p.MaxInputTokens {
+			violations = append(violations, policyViolation{
+				Rule:   "max_input_tokens",
+				Detail: fmt.Sprintf("estimated input is ~%d tokens, limit is %d", estimated, p.MaxInputTokens),
+			})
+		}
+	}
+
+	if len(p.BannedTools) > 0 {
+		banned := make(map[string]bool, len(p.BannedTools))
+		for _, t := range p.BannedTools {
+			banned[t] = true
+		}
+		if tools, ok := reqBody["tools"].([]interface{}); ok {
+			for _, t := range tools {
+				tool, ok := t.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				fn, ok := tool["function"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				name, _ := fn["name"].(string)
+				if banned[name] {
+					violations = append(violations, policyViolation{
+						Rule:   "banned_tools",
+						Detail: fmt.Sprintf("tool %q is not permitted", name),
+					})
+				}
+			}
+		}
+	}
+
+	if len(p.DisallowedFormats) > 0 {
+		if rf, ok := reqBody["response_format"].(map[string]interface{}); ok {
+			if formatType, ok := rf["type"].(string); ok {
+				for _, disallowed := range p.DisallowedFormats {
+					if formatType == disallowed {
+						violations = append(violations, policyViolation{
+							Rule:   "disallowed_response_format",
+							Detail: fmt.Sprintf("response_format %q is not permitted", formatType),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	if p.MaxN > 0 {
+		if n, ok := reqBody["n"].(float64); ok && int(n) > p.MaxN {
+			violations = append(violations, policyViolation{
+				Rule:   "max_n",
+				Detail: fmt.Sprintf("n=%v exceeds limit of %d", n, p.MaxN),
+			})
+		}
+	}
+
+	if p.MaxTemperature > 0 {
+		if temp, ok := reqBody["temperature"].(float64); ok && temp > p.MaxTemperature {
+			violations = append(violations, policyViolation{
+				Rule:   "max_temperature",
+				Detail: fmt.Sprintf("temperature=%v exceeds limit of %v", temp, p.MaxTemperature),
+			})
+		}
+	}
+
+	return violations
+}
+
+// enforcePolicy checks reqBody for tier against the store's current policy.
+// In dry-run mode, violations are logged and the request proceeds. In
+// enforcing mode, violations are written as a structured 400 response and
+// enforcePolicy returns false so the caller stops processing.
+func enforcePolicy(w http.ResponseWriter, store *policyStore, tier string, reqBody map[string]interface{}) (ok bool) {
+	if store == nil {
+		return true
+	}
+	policy, found := store.forTier(tier)
+	if !found {
+		return true
+	}
+
+	violations := policy.evaluate(reqBody)
+	if len(violations) == 0 {
+		return true
+	}
+
+	if store.dryRun() {
+		log.Printf("Policy dry-run violations (tier=%s): %+v", tier, violations)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message":    "request violates policy",
+			"violations": violations,
+		},
+	})
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func violationRules(violations []policyViolation) map[string]bool {
+	rules := make(map[string]bool, len(violations))
+	for _, v := range violations {
+		rules[v.Rule] = true
+	}
+	return rules
+}
+
+func TestRequestPolicyEvaluateNoViolations(t *testing.T) {
+	p := requestPolicy{MaxMessages: 10, MaxInputTokens: 1000, MaxN: 1, MaxTemperature: 1}
+	reqBody := map[string]interface{}{
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "hi"},
+		},
+	}
+	if violations := p.evaluate(reqBody); len(violations) != 0 {
+		t.Fatalf("expected no violations, got: %+v", violations)
+	}
+}
+
+func TestRequestPolicyEvaluateMaxMessages(t *testing.T) {
+	p := requestPolicy{MaxMessages: 1}
+	reqBody := map[string]interface{}{
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "one"},
+			map[string]interface{}{"role": "user", "content": "two"},
+		},
+	}
+	violations := p.evaluate(reqBody)
+	if !violationRules(violations)["max_messages"] {
+		t.Fatalf("expected max_messages violation, got: %+v", violations)
+	}
+}
+
+func TestRequestPolicyEvaluateMaxInputTokens(t *testing.T) {
+	p := requestPolicy{MaxInputTokens: 1}
+	reqBody := map[string]interface{}{
+		"messages": []interface{}{
+			map[string]interface{}{"role": "user", "content": "this message is definitely more than four characters"},
+		},
+	}
+	violations := p.evaluate(reqBody)
+	if !violationRules(violations)["max_input_tokens"] {
+		t.Fatalf("expected max_input_tokens violation, got: %+v", violations)
+	}
+}
+
+func TestRequestPolicyEvaluateBannedTools(t *testing.T) {
+	p := requestPolicy{BannedTools: []string{"shell_exec"}}
+	reqBody := map[string]interface{}{
+		"tools": []interface{}{
+			map[string]interface{}{"function": map[string]interface{}{"name": "shell_exec"}},
+		},
+	}
+	violations := p.evaluate(reqBody)
+	if !violationRules(violations)["banned_tools"] {
+		t.Fatalf("expected banned_tools violation, got: %+v", violations)
+	}
+}
+
+func TestRequestPolicyEvaluateDisallowedFormat(t *testing.T) {
+	p := requestPolicy{DisallowedFormats: []string{"json_object"}}
+	reqBody := map[string]interface{}{
+		"response_format": map[string]interface{}{"type": "json_object"},
+	}
+	violations := p.evaluate(reqBody)
+	if !violationRules(violations)["disallowed_response_format"] {
+		t.Fatalf("expected disallowed_response_format violation, got: %+v", violations)
+	}
+}
+
+func TestRequestPolicyEvaluateMaxNAndTemperature(t *testing.T) {
+	p := requestPolicy{MaxN: 1, MaxTemperature: 0.5}
+	reqBody := map[string]interface{}{
+		"n":           float64(3),
+		"temperature": float64(1.2),
+	}
+	violations := p.evaluate(reqBody)
+	rules := violationRules(violations)
+	if !rules["max_n"] {
+		t.Fatalf("expected max_n violation, got: %+v", violations)
+	}
+	if !rules["max_temperature"] {
+		t.Fatalf("expected max_temperature violation, got: %+v", violations)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// promptTemplateHashHeader surfaces the hash of the signed template that was
+// actually applied, so clients can verify (post-attestation) which system
+// prompt was used.
+const promptTemplateHashHeader = "X-Tinfoil-Prompt-Template-Hash"
+
+// templateManifestEntry is one named template in manifest.json: its body,
+// an Ed25519 signature over that body, and the tiers allowed to select it.
+type templateManifestEntry struct {
+	Body         string   `json:"body"`
+	Signature    string   `json:"signature"` // hex-encoded Ed25519 signature over Body
+	AllowedTiers []string `json:"allowed_tiers"`
+}
+
+// promptTemplate is a named, signature-verified system-prompt template.
+type promptTemplate struct {
+	name         string
+	hash         string // sha256 of the verified body, surfaced via promptTemplateHashHeader
+	allowedTiers map[string]bool
+	tmpl         *template.Template
+}
+
+// sandboxedTemplateFuncs is the fixed set of funcs available to prompt
+// templates, deliberately small so a template cannot reach arbitrary Go code
+// or the filesystem.
+var sandboxedTemplateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// templateVars are the values substitutable into a prompt template, beyond
+// the original single {{LANGUAGE}} variable.
+type templateVars struct {
+	Language      string
+	UserTier      string
+	AllowedModels string
+	Date          string
+}
+
+// render expands the template with vars.
+func (t *promptTemplate) render(vars templateVars) (string, error) {
+	var buf strings.Builder
+	if err := t.tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("render template %q: %w", t.name, err)
+	}
+	return buf.String(), nil
+}
+
+// templateRegistry holds the signed, parsed prompt templates loaded at
+// startup, keyed by name, plus the name selected when a request doesn't ask
+// for one explicitly.
+type templateRegistry struct {
+	templates map[string]*promptTemplate
+	fallback  string
+}
+
+// resolve picks the template named by requestedName, falling back to the
+// registry's default when requestedName is empty, and rejects tiers that
+// aren't on the chosen template's allow-list (an empty allow-list permits
+// every tier).
+func (r *templateRegistry) resolve(requestedName, tier string) (*promptTemplate, error) {
+	name := requestedName
+	if name == "" {
+		name = r.fallback
+	}
+
+	tmpl, ok := r.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown prompt template %q", name)
+	}
+	if len(tmpl.allowedTiers) > 0 && !tmpl.allowedTiers[tier] {
+		return nil, fmt.Errorf("tier %q is not allowed to use template %q", tier, name)
+	}
+	return tmpl, nil
+}
+
+// loadTemplateRegistry reads manifest.json from dir (one entry per named
+// template), verifies each entry's Ed25519 signature against pubKey, and
+// compiles its body with text/template. Verifying against a pinned public
+// key means an operator cannot silently change a prompt inside the enclave
+// without the corresponding private key.
+func loadTemplateRegistry(dir string, pubKey ed25519.PublicKey) (*templateRegistry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("read template manifest: %w", err)
+	}
+
+	var entries map[string]templateManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse template manifest: %w", err)
+	}
+
+	reg := &templateRegistry{templates: make(map[string]*promptTemplate, len(entries))}
+	for name, entry := range entries {
+		sig, err := hex.DecodeString(entry.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: invalid signature encoding: %w", name, err)
+		}
+		if !ed25519.Verify(pubKey, []byte(entry.Body), sig) {
+			return nil, fmt.Errorf("template %q: signature verification failed", name)
+		}
+
+		tmpl, err := template.New(name).Funcs(sandboxedTemplateFuncs).Parse(entry.Body)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", name, err)
+		}
+
+		allowed := make(map[string]bool, len(entry.AllowedTiers))
+		for _, tier := range entry.AllowedTiers {
+			allowed[tier] = true
+		}
+
+		sum := sha256.Sum256([]byte(entry.Body))
+		reg.templates[name] = &promptTemplate{
+			name:         name,
+			hash:         hex.EncodeToString(sum[:]),
+			allowedTiers: allowed,
+			tmpl:         tmpl,
+		}
+	}
+
+	return reg, nil
+}
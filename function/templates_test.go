@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func newTestTemplate(t *testing.T, name string, allowedTiers ...string) *promptTemplate {
+	t.Helper()
+	tmpl, err := template.New(name).Funcs(sandboxedTemplateFuncs).Parse("hello {{.Language}}")
+	if err != nil {
+		t.Fatalf("failed to parse test template: %v", err)
+	}
+	allowed := make(map[string]bool, len(allowedTiers))
+	for _, tier := range allowedTiers {
+		allowed[tier] = true
+	}
+	return &promptTemplate{name: name, hash: "deadbeef", allowedTiers: allowed, tmpl: tmpl}
+}
+
+func TestTemplateRegistryResolveFallsBackToDefault(t *testing.T) {
+	reg := &templateRegistry{
+		templates: map[string]*promptTemplate{"default": newTestTemplate(t, "default")},
+		fallback:  "default",
+	}
+
+	tmpl, err := reg.resolve("", "free")
+	if err != nil {
+		t.Fatalf("expected fallback resolution to succeed, got: %v", err)
+	}
+	if tmpl.name != "default" {
+		t.Fatalf("expected default template, got %q", tmpl.name)
+	}
+}
+
+func TestTemplateRegistryResolveUnknownTemplate(t *testing.T) {
+	reg := &templateRegistry{templates: map[string]*promptTemplate{}, fallback: "default"}
+
+	if _, err := reg.resolve("missing", "free"); err == nil {
+		t.Fatal("expected an error for an unknown template name")
+	}
+}
+
+func TestTemplateRegistryResolveEmptyAllowListPermitsAnyTier(t *testing.T) {
+	reg := &templateRegistry{
+		templates: map[string]*promptTemplate{"open": newTestTemplate(t, "open")},
+	}
+
+	if _, err := reg.resolve("open", "free"); err != nil {
+		t.Fatalf("expected empty allow-list to permit any tier, got: %v", err)
+	}
+}
+
+func TestTemplateRegistryResolveEnforcesAllowList(t *testing.T) {
+	reg := &templateRegistry{
+		templates: map[string]*promptTemplate{"paid-only": newTestTemplate(t, "paid-only", "paid")},
+	}
+
+	if _, err := reg.resolve("paid-only", "paid"); err != nil {
+		t.Fatalf("expected paid tier to be allowed, got: %v", err)
+	}
+	if _, err := reg.resolve("paid-only", "free"); err == nil {
+		t.Fatal("expected free tier to be rejected by the allow-list")
+	}
+}
+
+func TestLoadTemplateRegistryVerifiesSignatureAndAllowList(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	body := "hello {{.Language}}"
+	sig := ed25519.Sign(priv, []byte(body))
+
+	manifest := map[string]templateManifestEntry{
+		"default": {Body: body, Signature: hex.EncodeToString(sig), AllowedTiers: []string{"paid"}},
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), data, 0o600); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+
+	reg, err := loadTemplateRegistry(dir, pub)
+	if err != nil {
+		t.Fatalf("loadTemplateRegistry failed: %v", err)
+	}
+	if _, err := reg.resolve("default", "paid"); err != nil {
+		t.Fatalf("expected paid tier to be allowed, got: %v", err)
+	}
+	if _, err := reg.resolve("default", "free"); err == nil {
+		t.Fatal("expected free tier to be rejected by the allow-list")
+	}
+}
+
+func TestLoadTemplateRegistryRejectsBadSignature(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	manifest := map[string]templateManifestEntry{
+		"default": {Body: "hello", Signature: hex.EncodeToString(make([]byte, ed25519.SignatureSize))},
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), data, 0o600); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+
+	if _, err := loadTemplateRegistry(dir, pub); err == nil {
+		t.Fatal("expected an invalid signature to be rejected")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ResponseTransformer inspects (and may rewrite in place) a single decoded
+// chat.completion.chunk before it is re-serialized and flushed downstream.
+// Returning an error aborts the stream; the partially-written response is
+// left as-is since headers have already been sent.
+//
+// Transformers are the extension point for response-side policy: PII
+// redaction, token-count enforcement, tool-call rewriting, refusal
+// injection, etc.
+type ResponseTransformer func(chunk map[string]interface{}) error
+
+// responseTransformers is the ordered pipeline applied to every streamed
+// chunk. Register additions with registerResponseTransformer during init().
+var responseTransformers []ResponseTransformer
+
+// registerResponseTransformer appends t to the pipeline run over every
+// streamed chat completion chunk, in registration order.
+func registerResponseTransformer(t ResponseTransformer) {
+	responseTransformers = append(responseTransformers, t)
+}
+
+// chunkUsage mirrors the OpenAI `usage` object carried on the terminal
+// chat.completion.chunk when the client sets stream_options.include_usage.
+type chunkUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+const usageMetricsTrailer = "X-Tinfoil-Usage-Metrics"
+
+// streamChatCompletion reads an upstream SSE chat-completion body line by
+// line, runs each decoded `data: {...}` chunk through the registered
+// ResponseTransformers, re-serializes it, and flushes it to fw. `[DONE]`
+// sentinels, comment lines (":...") and blank keepalive lines are passed
+// through untouched.
+//
+// If the terminal chunk carries a `usage` object (stream_options with
+// include_usage=true), it is returned so the caller can surface it as the
+// X-Tinfoil-Usage-Metrics trailer, mirroring the trailer-based billing path
+// the proxy already understands.
+func streamChatCompletion(fw io.Writer, body io.Reader) (*chunkUsage, error) {
+	var usage *chunkUsage
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "" {
+			if _, err := fmt.Fprintf(fw, "%s\n\n", line); err != nil {
+				return usage, err
+			}
+			continue
+		}
+		if data == "[DONE]" {
+			if _, err := fmt.Fprintf(fw, "data: [DONE]\n\n"); err != nil {
+				return usage, err
+			}
+			continue
+		}
+
+		var chunk map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			// Not a JSON delta we understand (e.g. malformed upstream
+			// frame) — forward it verbatim rather than dropping it.
+			if _, err := fmt.Fprintf(fw, "data: %s\n\n", data); err != nil {
+				return usage, err
+			}
+			continue
+		}
+
+		for _, t := range responseTransformers {
+			if err := t(chunk); err != nil {
+				return usage, err
+			}
+		}
+
+		if rawUsage, ok := chunk["usage"]; ok && rawUsage != nil {
+			if usageBytes, err := json.Marshal(rawUsage); err == nil {
+				var u chunkUsage
+				if err := json.Unmarshal(usageBytes, &u); err == nil {
+					usage = &u
+				}
+			}
+		}
+
+		rewritten, err := json.Marshal(chunk)
+		if err != nil {
+			return usage, err
+		}
+		if _, err := fmt.Fprintf(fw, "data: %s\n\n", rewritten); err != nil {
+			return usage, err
+		}
+	}
+
+	return usage, scanner.Err()
+}
+
+// transformNonStreamingCompletion applies the registered ResponseTransformers
+// to a single (non-streamed) chat.completion object and returns the
+// re-serialized body plus any usage metrics found on it.
+func transformNonStreamingCompletion(body []byte) ([]byte, *chunkUsage, error) {
+	var completion map[string]interface{}
+	if err := json.Unmarshal(body, &completion); err != nil {
+		// Not JSON we understand — forward unmodified.
+		return body, nil, nil
+	}
+
+	for _, t := range responseTransformers {
+		if err := t(completion); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var usage *chunkUsage
+	if rawUsage, ok := completion["usage"]; ok && rawUsage != nil {
+		if usageBytes, err := json.Marshal(rawUsage); err == nil {
+			var u chunkUsage
+			if err := json.Unmarshal(usageBytes, &u); err == nil {
+				usage = &u
+			}
+		}
+	}
+
+	rewritten, err := json.Marshal(completion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rewritten, usage, nil
+}
+
+// setUsageTrailer announces and writes the X-Tinfoil-Usage-Metrics trailer
+// on w. It must be called after the response body has been fully written,
+// and the header must have been announced beforehand via
+// announceUsageTrailer.
+func setUsageTrailer(w http.ResponseWriter, usage *chunkUsage) {
+	if usage == nil {
+		return
+	}
+	value, err := json.Marshal(usage)
+	if err != nil {
+		log.Printf("Failed to marshal usage metrics: %v", err)
+		return
+	}
+	w.Header().Set(http.TrailerPrefix+usageMetricsTrailer, string(value))
+}
+
+// announceUsageTrailer declares the X-Tinfoil-Usage-Metrics trailer so the
+// net/http server knows to send it after a chunked response body. Must be
+// called before WriteHeader.
+func announceUsageTrailer(w http.ResponseWriter) {
+	w.Header().Set(http.TrailerPrefix+usageMetricsTrailer, "")
+}
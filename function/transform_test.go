@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamChatCompletionPassesThroughAndCapturesUsage(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"id":"1","choices":[{"delta":{"content":"hi"}}]}`,
+		"",
+		`data: {"id":"1","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		"",
+		"data: [DONE]",
+		"",
+	}, "\n")
+
+	var out bytes.Buffer
+	usage, err := streamChatCompletion(&out, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("streamChatCompletion returned error: %v", err)
+	}
+	if usage == nil {
+		t.Fatal("expected usage to be captured from terminal chunk")
+	}
+	if usage.TotalTokens != 5 || usage.PromptTokens != 3 || usage.CompletionTokens != 2 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	if !strings.Contains(out.String(), `"content":"hi"`) {
+		t.Fatalf("expected first chunk to be forwarded, got: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "data: [DONE]") {
+		t.Fatalf("expected [DONE] sentinel to be forwarded, got: %s", out.String())
+	}
+}
+
+func TestStreamChatCompletionNoUsage(t *testing.T) {
+	body := "data: {\"id\":\"1\",\"choices\":[]}\n\ndata: [DONE]\n\n"
+
+	var out bytes.Buffer
+	usage, err := streamChatCompletion(&out, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("streamChatCompletion returned error: %v", err)
+	}
+	if usage != nil {
+		t.Fatalf("expected no usage, got: %+v", usage)
+	}
+}
+
+func TestTransformNonStreamingCompletionCapturesUsage(t *testing.T) {
+	body := []byte(`{"id":"1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":4,"total_tokens":14}}`)
+
+	rewritten, usage, err := transformNonStreamingCompletion(body)
+	if err != nil {
+		t.Fatalf("transformNonStreamingCompletion returned error: %v", err)
+	}
+	if usage == nil || usage.TotalTokens != 14 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	if !bytes.Contains(rewritten, []byte(`"total_tokens":14`)) {
+		t.Fatalf("expected rewritten body to preserve usage, got: %s", rewritten)
+	}
+}
+
+func TestTransformNonStreamingCompletionNonJSONPassesThrough(t *testing.T) {
+	body := []byte("not json")
+
+	rewritten, usage, err := transformNonStreamingCompletion(body)
+	if err != nil {
+		t.Fatalf("transformNonStreamingCompletion returned error: %v", err)
+	}
+	if usage != nil {
+		t.Fatalf("expected no usage for non-JSON body, got: %+v", usage)
+	}
+	if !bytes.Equal(rewritten, body) {
+		t.Fatalf("expected body to be forwarded unmodified, got: %s", rewritten)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// attestationTTL is how long a fetched attestation bundle is served from
+// cache before being re-fetched from ATC.
+const attestationTTL = 5 * time.Minute
+
+// measurementSet is the set of measurements an attestation bundle is
+// expected to match, loaded from TINFOIL_MEASUREMENTS_FILE.
+type measurementSet struct {
+	Measurements map[string]string `json:"measurements"`
+}
+
+// loadExpectedMeasurements reads the pinned measurement set from the file
+// named by TINFOIL_MEASUREMENTS_FILE. If unset, verification is skipped and
+// every fetched bundle is trusted as-is (useful for local development).
+func loadExpectedMeasurements() (*measurementSet, error) {
+	path := os.Getenv("TINFOIL_MEASUREMENTS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read measurements file: %w", err)
+	}
+	var set measurementSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse measurements file: %w", err)
+	}
+	return &set, nil
+}
+
+// verify checks that bundle's measurements match the pinned set. A nil
+// receiver always passes (no pinned measurements configured).
+func (m *measurementSet) verify(bundle []byte) error {
+	if m == nil {
+		return nil
+	}
+	var got measurementSet
+	if err := json.Unmarshal(bundle, &got); err != nil {
+		return fmt.Errorf("parse attestation bundle: %w", err)
+	}
+	for name, expected := range m.Measurements {
+		actual, ok := got.Measurements[name]
+		if !ok {
+			return fmt.Errorf("attestation bundle missing measurement %q", name)
+		}
+		if actual != expected {
+			return fmt.Errorf("attestation measurement %q mismatch: expected %s, got %s", name, expected, actual)
+		}
+	}
+	return nil
+}
+
+// attestationCircuitBreaker trips after consecutive upstream failures and
+// short-circuits further fetch attempts until cooldown elapses, so a
+// flapping ATC does not turn into client-visible failures as long as a
+// cached bundle is still available.
+type attestationCircuitBreaker struct {
+	mu          sync.Mutex
+	failures    int
+	openUntil   time.Time
+	maxFailures int
+	cooldown    time.Duration
+}
+
+func newAttestationCircuitBreaker() *attestationCircuitBreaker {
+	return &attestationCircuitBreaker{maxFailures: 3, cooldown: 30 * time.Second}
+}
+
+func (cb *attestationCircuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return time.Now().After(cb.openUntil)
+}
+
+func (cb *attestationCircuitBreaker) recordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+}
+
+func (cb *attestationCircuitBreaker) recordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.failures >= cb.maxFailures {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+	}
+}
+
+// attestationCache fetches, verifies, and caches the attestation bundle from
+// ATC, refreshing it in the background on attestationTTL with jittered
+// backoff on failure. It serves stale-but-cached bundles through outages via
+// the circuit breaker rather than surfacing errors to clients.
+type attestationCache struct {
+	expected *measurementSet
+	breaker  *attestationCircuitBreaker
+
+	mu          sync.RWMutex
+	bundle      []byte
+	etag        string
+	fetchedAt   time.Time
+	contentType string
+}
+
+func newAttestationCache(expected *measurementSet) *attestationCache {
+	return &attestationCache{
+		expected: expected,
+		breaker:  newAttestationCircuitBreaker(),
+	}
+}
+
+// snapshot returns the currently cached bundle, its ETag, content type, and
+// age. ok is false if nothing has been successfully fetched yet.
+func (c *attestationCache) snapshot() (bundle []byte, etag, contentType string, age time.Duration, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.bundle == nil {
+		return nil, "", "", 0, false
+	}
+	return c.bundle, c.etag, c.contentType, time.Since(c.fetchedAt), true
+}
+
+// measurements returns the measurement set from the currently cached
+// bundle, for the /attestation/measurements endpoint.
+func (c *attestationCache) measurements() (map[string]string, bool) {
+	bundle, _, _, _, ok := c.snapshot()
+	if !ok {
+		return nil, false
+	}
+	var set measurementSet
+	if err := json.Unmarshal(bundle, &set); err != nil {
+		return nil, false
+	}
+	return set.Measurements, true
+}
+
+// refresh fetches a fresh bundle from ATC, verifies it, and updates the
+// cache. It logs a structured audit record whenever the measurement set
+// changes from what was previously cached.
+func (c *attestationCache) refresh() error {
+	if !c.breaker.allow() {
+		return fmt.Errorf("attestation circuit breaker open")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://atc.tinfoil.sh/attestation", nil)
+	if err != nil {
+		return fmt.Errorf("build attestation request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.breaker.recordFailure()
+		return fmt.Errorf("fetch attestation bundle: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.breaker.recordFailure()
+		return fmt.Errorf("read attestation bundle: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.breaker.recordFailure()
+		return fmt.Errorf("attestation fetch returned status %d", resp.StatusCode)
+	}
+
+	if err := c.expected.verify(body); err != nil {
+		c.breaker.recordFailure()
+		return fmt.Errorf("attestation verification failed: %w", err)
+	}
+
+	c.breaker.recordSuccess()
+	c.auditMeasurementChange(body)
+
+	sum := sha256.Sum256(body)
+	c.mu.Lock()
+	c.bundle = body
+	c.etag = `"` + hex.EncodeToString(sum[:]) + `"`
+	c.fetchedAt = time.Now()
+	c.contentType = resp.Header.Get("Content-Type")
+	c.mu.Unlock()
+
+	return nil
+}
+
+// auditMeasurementChange logs a structured record when the new bundle's
+// measurements differ from whatever is currently cached, so operators have
+// an audit trail of enclave upgrades.
+func (c *attestationCache) auditMeasurementChange(newBundle []byte) {
+	var newSet measurementSet
+	if err := json.Unmarshal(newBundle, &newSet); err != nil {
+		return
+	}
+
+	prevMeasurements, hadPrev := c.measurements()
+	if hadPrev && measurementsEqual(prevMeasurements, newSet.Measurements) {
+		return
+	}
+
+	record, _ := json.Marshal(map[string]interface{}{
+		"event":        "attestation_measurement_change",
+		"had_previous": hadPrev,
+		"measurements": newSet.Measurements,
+	})
+	log.Printf("AUDIT %s", record)
+}
+
+func measurementsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// runRefresher fetches immediately and then repeats every attestationTTL,
+// with full jitter on top of an exponential backoff when refresh fails, so a
+// flapping ATC doesn't cause a thundering herd of retries.
+func (c *attestationCache) runRefresher() {
+	backoff := time.Second
+
+	for {
+		if err := c.refresh(); err != nil {
+			log.Printf("attestation refresh failed: %v", err)
+			sleep := time.Duration(rand.Int63n(int64(backoff)))
+			time.Sleep(sleep)
+			backoff *= 2
+			if backoff > attestationTTL {
+				backoff = attestationTTL
+			}
+			continue
+		}
+		backoff = time.Second
+		time.Sleep(attestationTTL)
+	}
+}
+
+// fetchFreshnessProof fetches an attestation bundle directly from ATC for a
+// POST request carrying a client-supplied freshness nonce in its body. Each
+// nonce makes the response unique, so — unlike the cached GET path — this
+// is never served from or stored into the shared cache; it is still
+// verified against the pinned measurement set before being returned.
+func fetchFreshnessProof(expected *measurementSet, r *http.Request) (body []byte, contentType string, err error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "https://atc.tinfoil.sh/attestation", r.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("build attestation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch attestation bundle: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("read attestation bundle: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("attestation fetch returned status %d", resp.StatusCode)
+	}
+	if err := expected.verify(body); err != nil {
+		return nil, "", fmt.Errorf("attestation verification failed: %w", err)
+	}
+
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// cachedAttestationHandler serves the cached, verified attestation bundle on
+// GET — honoring conditional If-None-Match requests and refreshing
+// synchronously on a cold cache (first request before the background
+// refresher has run) — and forwards POST requests (a client-supplied
+// freshness nonce) straight through to ATC via fetchFreshnessProof.
+func cachedAttestationHandler(cache *attestationCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, If-None-Match")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			body, contentType, err := fetchFreshnessProof(cache.expected, r)
+			if err != nil {
+				log.Printf("attestation freshness proof failed: %v", err)
+				http.Error(w, "Failed to fetch attestation bundle", http.StatusBadGateway)
+				return
+			}
+			if contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.WriteHeader(http.StatusOK)
+			if _, err := w.Write(body); err != nil {
+				log.Printf("attestation response write failed: %v", err)
+			}
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		bundle, etag, contentType, age, ok := cache.snapshot()
+		if !ok {
+			if err := cache.refresh(); err != nil {
+				log.Printf("attestation cold fetch failed: %v", err)
+				http.Error(w, "Failed to fetch attestation bundle", http.StatusBadGateway)
+				return
+			}
+			bundle, etag, contentType, age, _ = cache.snapshot()
+		}
+
+		if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Age", fmt.Sprintf("%d", int(age.Seconds())))
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(bundle); err != nil {
+			log.Printf("attestation response write failed: %v", err)
+		}
+	}
+}
+
+// measurementsHandler exposes the measurement set from the currently
+// trusted (cached) attestation bundle.
+func measurementsHandler(cache *attestationCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		measurements, ok := cache.measurements()
+		if !ok {
+			http.Error(w, "No attestation bundle cached yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"measurements": measurements,
+		}); err != nil {
+			log.Printf("measurements response write failed: %v", err)
+		}
+	}
+}
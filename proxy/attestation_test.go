@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestMeasurementSetVerifyNilReceiverAlwaysPasses(t *testing.T) {
+	var m *measurementSet
+	if err := m.verify([]byte(`{"measurements":{}}`)); err != nil {
+		t.Fatalf("expected nil receiver to always pass, got: %v", err)
+	}
+}
+
+func TestMeasurementSetVerifyMatches(t *testing.T) {
+	m := &measurementSet{Measurements: map[string]string{"tdx": "abc123"}}
+	bundle := []byte(`{"measurements":{"tdx":"abc123","extra":"ignored"}}`)
+	if err := m.verify(bundle); err != nil {
+		t.Fatalf("expected matching measurements to pass, got: %v", err)
+	}
+}
+
+func TestMeasurementSetVerifyMismatch(t *testing.T) {
+	m := &measurementSet{Measurements: map[string]string{"tdx": "abc123"}}
+	bundle := []byte(`{"measurements":{"tdx":"different"}}`)
+	if err := m.verify(bundle); err == nil {
+		t.Fatal("expected mismatched measurement to fail verification")
+	}
+}
+
+func TestMeasurementSetVerifyMissingMeasurement(t *testing.T) {
+	m := &measurementSet{Measurements: map[string]string{"tdx": "abc123"}}
+	bundle := []byte(`{"measurements":{}}`)
+	if err := m.verify(bundle); err == nil {
+		t.Fatal("expected missing measurement to fail verification")
+	}
+}
+
+func TestMeasurementSetVerifyInvalidBundle(t *testing.T) {
+	m := &measurementSet{Measurements: map[string]string{"tdx": "abc123"}}
+	if err := m.verify([]byte("not json")); err == nil {
+		t.Fatal("expected invalid bundle JSON to fail verification")
+	}
+}
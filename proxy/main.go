@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"time"
 )
 
 const (
@@ -16,10 +18,10 @@ const (
 	usageMetricsResponseHeader = "X-Tinfoil-Usage-Metrics"
 
 	// CORS headers allowed in requests
-	allowHeaders = "Accept, Authorization, Content-Type, Ehbp-Encapsulated-Key, X-Tinfoil-Enclave-Url, X-Language, X-User-Tier"
+	allowHeaders = "Accept, Authorization, Content-Type, Ehbp-Encapsulated-Key, X-Tinfoil-Enclave-Url, X-Language, X-User-Tier, X-Prompt-Template"
 
 	// CORS headers exposed to the browser in responses
-	exposeHeaders = "Ehbp-Response-Nonce"
+	exposeHeaders = "Ehbp-Response-Nonce, X-Tinfoil-Prompt-Template-Hash"
 )
 
 // These encryption headers must be preserved for the protocol to work
@@ -28,9 +30,29 @@ var (
 	ehbpResponseHeaders = []string{"Ehbp-Response-Nonce"}
 )
 
+// limiter enforces the per-tier quotas described in tierPolicy. It is
+// initialized once in main from the configured policy file (or
+// defaultTierPolicies) and shared across requests.
+var limiter *rateLimiter
+
 func main() {
+	policies, err := loadTierPolicies()
+	if err != nil {
+		log.Fatalf("Failed to load rate limit policies: %v", err)
+	}
+	limiter = newRateLimiter(policies, newMemoryQuotaBackend())
+
+	expectedMeasurements, err := loadExpectedMeasurements()
+	if err != nil {
+		log.Fatalf("Failed to load pinned measurements: %v", err)
+	}
+	attestation := newAttestationCache(expectedMeasurements)
+	go attestation.runRefresher()
+
 	http.HandleFunc("/v1/chat/completions", proxyHandler)
-	http.HandleFunc("/attestation", attestationHandler)
+	http.HandleFunc("/attestation", cachedAttestationHandler(attestation))
+	http.HandleFunc("/attestation/measurements", measurementsHandler(attestation))
+	http.HandleFunc("/metrics", metrics.handler())
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -41,34 +63,69 @@ func main() {
 }
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received %s request from %s", r.Method, r.RemoteAddr)
-
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
-	w.Header().Set("Access-Control-Expose-Headers", exposeHeaders)
+	start := time.Now()
+	trace := extractTraceContext(r)
+	tier := tierFor(r)
+	language := r.Header.Get("X-Language")
+	enclaveURL := r.Header.Get(enclaveURLHeader)
+
+	// sw captures the status code written on every exit path (rate-limit
+	// 429s, validation 4xxs, upstream 5xxs, successful round-trips alike) so
+	// the deferred call below can record per-tier request/error counters
+	// regardless of where the handler returns.
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		metrics.incCounter("tinfoil_proxy_requests_total", map[string]string{"tier": tier, "status": fmt.Sprintf("%d", sw.status)})
+		if sw.status >= 500 {
+			metrics.incCounter("tinfoil_proxy_errors_total", map[string]string{"source": "upstream", "tier": tier})
+		} else if sw.status >= 400 {
+			metrics.incCounter("tinfoil_proxy_errors_total", map[string]string{"source": "client", "tier": tier})
+		}
+	}()
+
+	logEvent(map[string]interface{}{
+		"event":       "request_received",
+		"trace_id":    trace.traceID,
+		"method":      r.Method,
+		"remote":      r.RemoteAddr,
+		"tier":        tier,
+		"language":    language,
+		"enclave_url": enclaveURL,
+	})
+
+	sw.Header().Set("Access-Control-Allow-Origin", "*")
+	sw.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	sw.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+	sw.Header().Set("Access-Control-Expose-Headers", exposeHeaders)
 
 	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
+		sw.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	release, policy, ok := limiter.allow(sw, r)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Get upstream URL from the X-Tinfoil-Enclave-Url header (points to the function enclave)
-	upstreamBase := r.Header.Get(enclaveURLHeader)
-	if upstreamBase == "" {
+	if enclaveURL == "" {
 		log.Println("Error: X-Tinfoil-Enclave-Url header not provided")
-		http.Error(w, "X-Tinfoil-Enclave-Url header required", http.StatusBadRequest)
+		http.Error(sw, "X-Tinfoil-Enclave-Url header required", http.StatusBadRequest)
 		return
 	}
-	upstreamURL := upstreamBase + r.URL.Path
+	upstreamURL := enclaveURL + r.URL.Path
 
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstreamURL, r.Body)
+	reqBody := &countingReadCloser{rc: r.Body}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, upstreamURL, reqBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(sw, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", trace.header())
 	if accept := r.Header.Get("Accept"); accept != "" {
 		req.Header.Set("Accept", accept)
 	}
@@ -87,48 +144,139 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// Business logic: enrich the upstream request with function-specific headers
 	setLanguageHeader(req.Header, r.Header)
 	setAllowedModelsHeader(req.Header, r.Header)
+	setUserTierHeader(req.Header, r.Header)
+	setPromptTemplateHeader(req.Header, r.Header)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		http.Error(sw, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	metrics.observe("tinfoil_proxy_request_bytes", map[string]string{"tier": tier}, float64(reqBody.bytes))
+
 	// Required: Copy encryption headers from the upstream response
-	copyHeaders(w.Header(), resp.Header, ehbpResponseHeaders...)
+	copyHeaders(sw.Header(), resp.Header, ehbpResponseHeaders...)
 
 	if ct := resp.Header.Get("Content-Type"); ct != "" {
-		w.Header().Set("Content-Type", ct)
+		sw.Header().Set("Content-Type", ct)
 	}
 
 	// Log usage metrics from response header (non-streaming) for billing
 	if usage := resp.Header.Get(usageMetricsResponseHeader); usage != "" {
 		log.Printf("Usage metrics (header): %s", usage)
+		tokens := usageTokensFromHeader(usage)
+		limiter.reportUsage(r, policy, tokens)
+		// Model is unavailable here (the request body is EHBP-encrypted at
+		// the proxy layer), so token usage is only broken out by tier.
+		metrics.observe("tinfoil_proxy_token_usage", map[string]string{"tier": tier}, float64(tokens))
 	}
 
 	if te := resp.Header.Get("Transfer-Encoding"); te != "" {
-		w.Header().Set("Transfer-Encoding", te)
-		w.Header().Del("Content-Length")
+		sw.Header().Set("Transfer-Encoding", te)
+		sw.Header().Del("Content-Length")
 	}
 
-	w.WriteHeader(resp.StatusCode)
+	sw.WriteHeader(resp.StatusCode)
 
-	if flusher, ok := w.(http.Flusher); ok {
-		fw := &flushWriter{w: w, f: flusher}
-		if _, copyErr := io.Copy(fw, resp.Body); copyErr != nil {
-			log.Printf("stream copy failed: %v", copyErr)
-		}
-	} else {
-		if _, copyErr := io.Copy(w, resp.Body); copyErr != nil {
-			log.Printf("response copy failed: %v", copyErr)
-		}
+	meter := &responseMeter{start: start}
+
+	// sw always implements http.Flusher (it forwards to the underlying
+	// ResponseWriter's Flusher, if any), so the streamed copy can go through
+	// flushWriter unconditionally.
+	fw := &flushWriter{w: meteredWriter{w: sw, meter: meter}, f: sw}
+	if _, copyErr := io.Copy(fw, resp.Body); copyErr != nil {
+		log.Printf("stream copy failed: %v", copyErr)
+	}
+
+	if meter.timeToFirstByte > 0 {
+		metrics.observe("tinfoil_proxy_ttfb_seconds", map[string]string{"tier": tier}, meter.timeToFirstByte.Seconds())
 	}
+	metrics.observe("tinfoil_proxy_response_bytes", map[string]string{"tier": tier}, float64(meter.bytes))
 
 	// After body is fully read, log usage metrics from trailer (streaming) for billing
 	if usage := resp.Trailer.Get(usageMetricsResponseHeader); usage != "" {
 		log.Printf("Usage metrics (trailer): %s", usage)
+		tokens := usageTokensFromHeader(usage)
+		limiter.reportUsage(r, policy, tokens)
+		metrics.observe("tinfoil_proxy_token_usage", map[string]string{"tier": tier}, float64(tokens))
 	}
+
+	elapsed := time.Since(start)
+	metrics.observe("tinfoil_proxy_upstream_latency_seconds", map[string]string{"tier": tier}, elapsed.Seconds())
+	logEvent(map[string]interface{}{
+		"event":       "request_completed",
+		"trace_id":    trace.traceID,
+		"tier":        tier,
+		"language":    language,
+		"enclave_url": enclaveURL,
+		"status":      resp.StatusCode,
+		"duration_ms": elapsed.Milliseconds(),
+	})
+}
+
+// statusWriter wraps http.ResponseWriter, capturing the status code written
+// so callers can record metrics for a request after the handler has already
+// written its response, regardless of which exit path it took.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Flush forwards to the underlying ResponseWriter's Flusher, if any, so
+// statusWriter stays transparent to http.Flusher type assertions used for
+// SSE streaming.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// responseMeter tracks response byte count and time-to-first-byte for a
+// single request/response cycle.
+type responseMeter struct {
+	start           time.Time
+	bytes           int64
+	timeToFirstByte time.Duration
+}
+
+// meteredWriter wraps an io.Writer, feeding byte counts and first-write
+// timing into a responseMeter.
+type meteredWriter struct {
+	w     io.Writer
+	meter *responseMeter
+}
+
+func (m meteredWriter) Write(p []byte) (int, error) {
+	if m.meter.bytes == 0 {
+		m.meter.timeToFirstByte = time.Since(m.meter.start)
+	}
+	n, err := m.w.Write(p)
+	m.meter.bytes += int64(n)
+	return n, err
+}
+
+// countingReadCloser wraps an io.ReadCloser, tallying bytes read so the
+// request body size can be observed once upstream has finished reading it.
+type countingReadCloser struct {
+	rc    io.ReadCloser
+	bytes int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.rc.Read(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	return c.rc.Close()
 }
 
 type flushWriter struct {
@@ -163,55 +311,27 @@ func setAllowedModelsHeader(dst, src http.Header) {
 	log.Printf("User tier: %s, allowed models: %s", userTier, dst.Get("X-Allowed-Models"))
 }
 
-func copyHeaders(dst, src http.Header, keys ...string) {
-	for _, key := range keys {
-		if value := src.Get(key); value != "" {
-			dst.Set(key, value)
-		}
+// setUserTierHeader forwards the caller's tier so the function can
+// allow-list per-tenant prompt templates the same way the proxy already
+// allow-lists models in setAllowedModelsHeader.
+func setUserTierHeader(dst, src http.Header) {
+	if tier := src.Get("X-User-Tier"); tier != "" {
+		dst.Set("X-User-Tier", tier)
 	}
 }
 
-func attestationHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received attestation %s request from %s", r.Method, r.RemoteAddr)
-
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-
-	if r.Method != http.MethodGet && r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	req, err := http.NewRequest(r.Method, "https://atc.tinfoil.sh/attestation", r.Body)
-	if err != nil {
-		log.Printf("Failed to create attestation request: %v", err)
-		http.Error(w, "Failed to create attestation request", http.StatusInternalServerError)
-		return
-	}
-	if r.Method == http.MethodPost {
-		req.Header.Set("Content-Type", "application/json")
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Printf("Failed to fetch attestation bundle: %v", err)
-		http.Error(w, "Failed to fetch attestation bundle", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	if ct := resp.Header.Get("Content-Type"); ct != "" {
-		w.Header().Set("Content-Type", ct)
+// setPromptTemplateHeader forwards the caller's requested prompt template
+// name; the function resolves and verifies it against the tier's allow-list.
+func setPromptTemplateHeader(dst, src http.Header) {
+	if name := src.Get("X-Prompt-Template"); name != "" {
+		dst.Set("X-Prompt-Template", name)
 	}
+}
 
-	w.WriteHeader(resp.StatusCode)
-	if _, copyErr := io.Copy(w, resp.Body); copyErr != nil {
-		log.Printf("attestation response copy failed: %v", copyErr)
+func copyHeaders(dst, src http.Header, keys ...string) {
+	for _, key := range keys {
+		if value := src.Get(key); value != "" {
+			dst.Set(key, value)
+		}
 	}
 }
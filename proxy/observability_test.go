@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHistogramObserveBucketCounts(t *testing.T) {
+	h := newHistogram()
+	h.observe(0.02)
+	h.observe(0.2)
+	h.observe(20)
+
+	if h.count != 3 {
+		t.Fatalf("expected count 3, got %d", h.count)
+	}
+	if h.sum != 0.02+0.2+20 {
+		t.Fatalf("expected sum %v, got %v", 0.02+0.2+20, h.sum)
+	}
+
+	// buckets are cumulative: 0.05 only saw the first observation, 0.25 saw
+	// the first two, and the final "+Inf" bucket saw all three.
+	if got := h.counts[1]; got != 1 {
+		t.Fatalf("expected bucket le=0.05 to have count 1, got %d", got)
+	}
+	if got := h.counts[4]; got != 2 {
+		t.Fatalf("expected bucket le=0.25 to have count 2, got %d", got)
+	}
+	if got := h.counts[len(h.buckets)]; got != 3 {
+		t.Fatalf("expected +Inf bucket to have count 3, got %d", got)
+	}
+}
+
+func TestLabelKeySortsAndRendersLabels(t *testing.T) {
+	got := labelKey(map[string]string{"tier": "paid", "status": "200"})
+	want := `status="200",tier="paid"`
+	if got != want {
+		t.Fatalf("expected sorted label key %q, got %q", want, got)
+	}
+}
+
+func TestLabelKeyEmpty(t *testing.T) {
+	if got := labelKey(nil); got != "" {
+		t.Fatalf("expected empty label key for nil map, got %q", got)
+	}
+}
+
+func TestExtractTraceContextValidTraceparent(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	tc := extractTraceContext(r)
+	if tc.traceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Fatalf("expected inbound trace ID to be preserved, got %q", tc.traceID)
+	}
+	if tc.flags != "01" {
+		t.Fatalf("expected inbound flags to be preserved, got %q", tc.flags)
+	}
+	if tc.spanID == "" {
+		t.Fatal("expected a new span ID to be generated")
+	}
+}
+
+func TestExtractTraceContextMalformedTraceparent(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	r.Header.Set("traceparent", "not-a-valid-header")
+
+	tc := extractTraceContext(r)
+	if len(tc.traceID) != 32 {
+		t.Fatalf("expected a freshly generated 32-char trace ID, got %q", tc.traceID)
+	}
+}
+
+func TestExtractTraceContextAbsentTraceparent(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	tc := extractTraceContext(r)
+	if len(tc.traceID) != 32 {
+		t.Fatalf("expected a freshly generated 32-char trace ID, got %q", tc.traceID)
+	}
+	if len(tc.spanID) != 16 {
+		t.Fatalf("expected a freshly generated 16-char span ID, got %q", tc.spanID)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tierPolicy describes the quota granted to a single user tier.
+type tierPolicy struct {
+	RPS           float64 `json:"rps"`
+	Burst         int     `json:"burst"`
+	MaxConcurrent int     `json:"max_concurrent"`
+	DailyTokens   int64   `json:"daily_tokens"`
+}
+
+// defaultTierPolicies is used when TINFOIL_RATE_LIMIT_POLICY_FILE is not set.
+// It mirrors the tiers setAllowedModelsHeader already distinguishes.
+var defaultTierPolicies = map[string]tierPolicy{
+	"paid": {RPS: 5, Burst: 10, MaxConcurrent: 10, DailyTokens: 2_000_000},
+	"free": {RPS: 0.5, Burst: 2, MaxConcurrent: 1, DailyTokens: 20_000},
+}
+
+// loadTierPolicies reads per-tier quotas from the JSON file named by
+// TINFOIL_RATE_LIMIT_POLICY_FILE, falling back to defaultTierPolicies if the
+// env var is unset.
+func loadTierPolicies() (map[string]tierPolicy, error) {
+	path := os.Getenv("TINFOIL_RATE_LIMIT_POLICY_FILE")
+	if path == "" {
+		return defaultTierPolicies, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rate limit policy file: %w", err)
+	}
+	var policies map[string]tierPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("parse rate limit policy file: %w", err)
+	}
+	return policies, nil
+}
+
+// quotaBackend stores per-identity token buckets and daily token usage.
+// The in-memory implementation is the default; a Redis-backed
+// implementation can satisfy the same interface so multiple proxy replicas
+// share state.
+type quotaBackend interface {
+	// take attempts to remove one request token from identity's bucket for
+	// the given tier policy, refilling it first based on elapsed time.
+	// Returns whether the request is allowed and the seconds until the
+	// caller should retry if not.
+	take(identity string, policy tierPolicy) (allowed bool, retryAfter time.Duration)
+
+	// acquireConcurrency reserves one of maxConcurrent in-flight slots for
+	// identity. release must be called exactly once per successful
+	// acquisition.
+	acquireConcurrency(identity string, maxConcurrent int) (release func(), allowed bool)
+
+	// consumeTokens decrements identity's remaining daily token quota and
+	// reports whether it is already exhausted.
+	consumeTokens(identity string, tokens int64, dailyLimit int64) (exhausted bool)
+
+	// dailyExceeded reports whether identity has already used up its daily
+	// token quota, without consuming anything. Used to reject new requests
+	// before they are forwarded upstream.
+	dailyExceeded(identity string, dailyLimit int64) bool
+}
+
+// memoryQuotaBackend is the default quotaBackend: per-process state behind a
+// mutex. Fine for a single proxy replica; swap in a Redis-backed
+// implementation of quotaBackend for a multi-replica deployment.
+type memoryQuotaBackend struct {
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	inFlight map[string]int
+	daily    map[string]*dailyUsage
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+type dailyUsage struct {
+	day  string
+	used int64
+}
+
+func newMemoryQuotaBackend() *memoryQuotaBackend {
+	return &memoryQuotaBackend{
+		buckets:  make(map[string]*tokenBucket),
+		inFlight: make(map[string]int),
+		daily:    make(map[string]*dailyUsage),
+	}
+}
+
+func (m *memoryQuotaBackend) take(identity string, policy tierPolicy) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	b, ok := m.buckets[identity]
+	if !ok {
+		b = &tokenBucket{tokens: float64(policy.Burst), lastRefill: now}
+		m.buckets[identity] = b
+	}
+
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.tokens = minFloat(float64(policy.Burst), b.tokens+elapsed*policy.RPS)
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		deficit := 1 - b.tokens
+		retryAfter := time.Duration(deficit/policy.RPS*float64(time.Second)) + time.Millisecond
+		return false, retryAfter
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+func (m *memoryQuotaBackend) acquireConcurrency(identity string, maxConcurrent int) (func(), bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inFlight[identity] >= maxConcurrent {
+		return nil, false
+	}
+	m.inFlight[identity]++
+
+	release := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.inFlight[identity]--
+	}
+	return release, true
+}
+
+func (m *memoryQuotaBackend) consumeTokens(identity string, tokens int64, dailyLimit int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.todayUsage(identity)
+	u.used += tokens
+	return u.used > dailyLimit
+}
+
+func (m *memoryQuotaBackend) dailyExceeded(identity string, dailyLimit int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.todayUsage(identity).used > dailyLimit
+}
+
+// todayUsage returns identity's dailyUsage record, resetting it if the
+// calendar day has rolled over since it was last touched. Callers must hold
+// m.mu.
+func (m *memoryQuotaBackend) todayUsage(identity string) *dailyUsage {
+	today := time.Now().UTC().Format("2006-01-02")
+	u, ok := m.daily[identity]
+	if !ok || u.day != today {
+		u = &dailyUsage{day: today}
+		m.daily[identity] = u
+	}
+	return u
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// rateLimiter enforces the per-tier RPS, concurrency, and daily-token
+// quotas described in tierPolicy, keyed by an identity derived from the
+// request's Authorization header and X-User-Tier.
+type rateLimiter struct {
+	policies map[string]tierPolicy
+	backend  quotaBackend
+}
+
+func newRateLimiter(policies map[string]tierPolicy, backend quotaBackend) *rateLimiter {
+	return &rateLimiter{policies: policies, backend: backend}
+}
+
+// identityFor derives a stable per-caller identity from the Authorization
+// header (preferred, since it identifies the actual caller) falling back to
+// the remote address when no Authorization header is present.
+func identityFor(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return auth
+	}
+	return r.RemoteAddr
+}
+
+func tierFor(r *http.Request) string {
+	tier := r.Header.Get("X-User-Tier")
+	if tier == "" {
+		tier = "free"
+	}
+	return tier
+}
+
+// allow checks the request against its tier's RPS and concurrency quotas.
+// On success it returns a release func that MUST be called once the request
+// completes, and the tierPolicy so the caller can later report token usage
+// against the daily quota. On failure it writes the 429 response itself and
+// returns ok=false.
+func (rl *rateLimiter) allow(w http.ResponseWriter, r *http.Request) (release func(), policy tierPolicy, ok bool) {
+	tier := tierFor(r)
+	policy, known := rl.policies[tier]
+	if !known {
+		policy = rl.policies["free"]
+	}
+	identity := identityFor(r)
+
+	if rl.backend.dailyExceeded(identity, policy.DailyTokens) {
+		writeRateLimited(w, policy, dailyQuotaRetryAfter())
+		return nil, policy, false
+	}
+
+	allowed, retryAfter := rl.backend.take(identity, policy)
+	if !allowed {
+		writeRateLimited(w, policy, retryAfter)
+		return nil, policy, false
+	}
+
+	release, acquired := rl.backend.acquireConcurrency(identity, policy.MaxConcurrent)
+	if !acquired {
+		writeRateLimited(w, policy, time.Second)
+		return nil, policy, false
+	}
+
+	return release, policy, true
+}
+
+// reportUsage decrements identity's daily token quota by the usage reported
+// in an X-Tinfoil-Usage-Metrics response header/trailer. The request this
+// usage belongs to has already been served; going over the limit here only
+// means the *next* request for this identity will be rejected by allow's
+// dailyExceeded pre-check.
+func (rl *rateLimiter) reportUsage(r *http.Request, policy tierPolicy, totalTokens int64) {
+	identity := identityFor(r)
+	if rl.backend.consumeTokens(identity, totalTokens, policy.DailyTokens) {
+		log.Printf("Daily token quota exceeded for tier=%s identity-suffix=%s", tierFor(r), identitySuffix(identity))
+	}
+}
+
+// identitySuffix avoids logging full bearer tokens while still giving
+// operators something to correlate across log lines.
+func identitySuffix(identity string) string {
+	if len(identity) <= 8 {
+		return identity
+	}
+	return identity[len(identity)-8:]
+}
+
+// dailyQuotaRetryAfter returns how long until the daily token quota resets
+// (midnight UTC), for the Retry-After header on a quota-exceeded 429.
+func dailyQuotaRetryAfter() time.Duration {
+	now := time.Now().UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return tomorrow.Sub(now)
+}
+
+func writeRateLimited(w http.ResponseWriter, policy tierPolicy, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("RateLimit-Limit", fmt.Sprintf("%d", policy.Burst))
+	w.Header().Set("RateLimit-Remaining", "0")
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// usageTokensFromHeader parses the total_tokens field out of an
+// X-Tinfoil-Usage-Metrics value as produced by the function server's usage
+// trailer.
+func usageTokensFromHeader(value string) int64 {
+	if value == "" {
+		return 0
+	}
+	var usage struct {
+		TotalTokens int64 `json:"total_tokens"`
+	}
+	if err := json.Unmarshal([]byte(value), &usage); err != nil {
+		return 0
+	}
+	return usage.TotalTokens
+}
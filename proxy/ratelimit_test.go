@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryQuotaBackendTakeRefillsOverTime(t *testing.T) {
+	backend := newMemoryQuotaBackend()
+	policy := tierPolicy{RPS: 1, Burst: 2, MaxConcurrent: 10, DailyTokens: 1000}
+
+	if allowed, _ := backend.take("id", policy); !allowed {
+		t.Fatal("expected first request to be allowed (full burst)")
+	}
+	if allowed, _ := backend.take("id", policy); !allowed {
+		t.Fatal("expected second request to be allowed (burst of 2)")
+	}
+
+	allowed, retryAfter := backend.take("id", policy)
+	if allowed {
+		t.Fatal("expected third immediate request to be rejected (bucket empty)")
+	}
+	if retryAfter <= 0 {
+		t.Fatalf("expected a positive retryAfter, got %v", retryAfter)
+	}
+
+	// Simulate the bucket having refilled by backdating lastRefill.
+	backend.mu.Lock()
+	backend.buckets["id"].lastRefill = time.Now().Add(-2 * time.Second)
+	backend.mu.Unlock()
+
+	if allowed, _ := backend.take("id", policy); !allowed {
+		t.Fatal("expected request to be allowed after refill")
+	}
+}
+
+func TestMemoryQuotaBackendAcquireConcurrency(t *testing.T) {
+	backend := newMemoryQuotaBackend()
+
+	release1, ok := backend.acquireConcurrency("id", 1)
+	if !ok {
+		t.Fatal("expected first acquisition to succeed")
+	}
+	if _, ok := backend.acquireConcurrency("id", 1); ok {
+		t.Fatal("expected second acquisition to fail while slot is held")
+	}
+	release1()
+	if _, ok := backend.acquireConcurrency("id", 1); !ok {
+		t.Fatal("expected acquisition to succeed after release")
+	}
+}
+
+func TestMemoryQuotaBackendDailyQuota(t *testing.T) {
+	backend := newMemoryQuotaBackend()
+
+	if backend.dailyExceeded("id", 100) {
+		t.Fatal("expected quota not to be exceeded before any usage")
+	}
+	if exhausted := backend.consumeTokens("id", 60, 100); exhausted {
+		t.Fatal("did not expect quota to be exhausted after consuming under the limit")
+	}
+	if backend.dailyExceeded("id", 100) {
+		t.Fatal("expected quota not to be exceeded at 60/100")
+	}
+	if exhausted := backend.consumeTokens("id", 60, 100); !exhausted {
+		t.Fatal("expected quota to be exhausted after consuming past the limit")
+	}
+	if !backend.dailyExceeded("id", 100) {
+		t.Fatal("expected dailyExceeded to report true once past the limit")
+	}
+}
+
+func TestRateLimiterAllowRejectsAfterDailyQuotaExceeded(t *testing.T) {
+	backend := newMemoryQuotaBackend()
+	policies := map[string]tierPolicy{
+		"paid": {RPS: 1000, Burst: 1000, MaxConcurrent: 1000, DailyTokens: 10},
+	}
+	rl := newRateLimiter(policies, backend)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("X-User-Tier", "paid")
+	req.Header.Set("Authorization", "Bearer test-token")
+
+	release, policy, ok := rl.allow(httptest.NewRecorder(), req)
+	if !ok {
+		t.Fatal("expected first request to be allowed")
+	}
+	release()
+
+	rl.reportUsage(req, policy, 11)
+
+	rec := httptest.NewRecorder()
+	_, _, ok = rl.allow(rec, req)
+	if ok {
+		t.Fatal("expected request to be rejected once the daily token quota is exceeded")
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header to be set")
+	}
+}